@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// CORSRule describes the CORS policy applied to requests whose path starts
+// with PathPrefix. The rule with the longest matching PathPrefix wins; a
+// rule with PathPrefix "" acts as the catch-all default.
+type CORSRule struct {
+	PathPrefix string `json:"path_prefix"`
+
+	// AllowedOrigins supports exact origins, "*" for any origin, and a
+	// single "*" wildcard component per entry (e.g. "https://*.example.com"),
+	// modeled on rs/cors.
+	AllowedOrigins []string `json:"allowed_origins"`
+
+	AllowedMethods []string `json:"allowed_methods"`
+
+	// AllowedHeaders echoes back the preflight's
+	// Access-Control-Request-Headers when it contains "*"; otherwise it is
+	// sent verbatim.
+	AllowedHeaders []string `json:"allowed_headers"`
+
+	// AllowCredentials is independent of AllowedOrigins: it is legal to
+	// allow credentials alongside a wildcard origin, in which case the
+	// actual request Origin is echoed back instead of "*", since browsers
+	// reject a literal "*" on credentialed responses.
+	AllowCredentials bool `json:"allow_credentials"`
+
+	// MaxAge is the preflight cache lifetime in seconds. 0 omits the header.
+	MaxAge int `json:"max_age"`
+}
+
+// CORSConfig holds the full set of CORS rules for a Server.
+type CORSConfig struct {
+	Rules []CORSRule `json:"rules"`
+}
+
+// loadCORSConfig reads a CORSConfig from a JSON file, as pointed to by
+// -cors-config.
+func loadCORSConfig(path string) (*CORSConfig, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config CORSConfig
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// newCORSConfigFromWhitelist builds a single default CORSRule from the
+// legacy -cors flag, preserving its existing comma-separated-origins
+// behavior for backward compatibility.
+func newCORSConfigFromWhitelist(whitelist string, allowCredentials bool, maxAge int) *CORSConfig {
+	rawOrigins := strings.Split(strings.ReplaceAll(whitelist, " ", ""), ",")
+
+	origins := make([]string, 0, len(rawOrigins))
+	for _, origin := range rawOrigins {
+		if origin == "*" {
+			origins = []string{"*"}
+			break
+		}
+		valid, err := url.ParseRequestURI(origin)
+		if err != nil {
+			continue
+		}
+		origins = append(origins, valid.String())
+	}
+
+	return &CORSConfig{
+		Rules: []CORSRule{
+			{
+				PathPrefix:       "",
+				AllowedOrigins:   origins,
+				AllowedMethods:   []string{"GET", "OPTIONS"},
+				AllowedHeaders:   []string{"Content-Type", "Authorization"},
+				AllowCredentials: allowCredentials,
+				MaxAge:           maxAge,
+			},
+		},
+	}
+}
+
+// ruleForPath returns the rule with the longest matching PathPrefix, or nil
+// if no rule matches.
+func (c *CORSConfig) ruleForPath(path string) *CORSRule {
+	var best *CORSRule
+	bestLen := -1
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+		if strings.HasPrefix(path, rule.PathPrefix) && len(rule.PathPrefix) > bestLen {
+			best = rule
+			bestLen = len(rule.PathPrefix)
+		}
+	}
+	return best
+}
+
+// matchOrigin reports whether origin satisfies pattern. Patterns support a
+// single "*" wildcard component, e.g. "https://*.example.com" or a bare "*"
+// for any origin.
+func matchOrigin(pattern, origin string) bool {
+	if pattern == origin {
+		return true
+	}
+	if !strings.Contains(pattern, "*") {
+		return false
+	}
+
+	parts := strings.SplitN(pattern, "*", 2)
+	prefix, suffix := parts[0], parts[1]
+	return len(origin) >= len(prefix)+len(suffix) &&
+		strings.HasPrefix(origin, prefix) &&
+		strings.HasSuffix(origin, suffix)
+}
+
+// allowOrigin reports the Access-Control-Allow-Origin value to send for a
+// request Origin, and whether the origin is allowed at all. Requests with
+// no Origin header (plain same-origin requests, curl, health checks) are
+// never CORS requests and are always left alone.
+func (rule *CORSRule) allowOrigin(origin string) (string, bool) {
+	if origin == "" {
+		return "", false
+	}
+	for _, pattern := range rule.AllowedOrigins {
+		if !matchOrigin(pattern, origin) {
+			continue
+		}
+		if pattern == "*" && !rule.AllowCredentials {
+			return "*", true
+		}
+		// Credentialed responses, or a non-wildcard match, always echo
+		// back the exact origin.
+		return origin, true
+	}
+	return "", false
+}
+
+// allowHeaders resolves the Access-Control-Allow-Headers value for a
+// preflight request, echoing back Access-Control-Request-Headers when the
+// rule allows "*".
+func (rule *CORSRule) allowHeaders(requested string) string {
+	for _, h := range rule.AllowedHeaders {
+		if h == "*" {
+			if requested == "" {
+				return strings.Join(rule.AllowedHeaders, ", ")
+			}
+			return requested
+		}
+	}
+	return strings.Join(rule.AllowedHeaders, ", ")
+}
+
+// corsMiddleware applies the Server's CORSConfig, picking the most specific
+// rule for the request path and handling preflight (OPTIONS) requests,
+// modeled on rs/cors.
+func (server *Server) corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rule := server.CORSConfig.ruleForPath(r.URL.Path)
+		if rule == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		origin := r.Header.Get("Origin")
+		if allowedOrigin, ok := rule.allowOrigin(origin); ok {
+			w.Header().Set("Access-Control-Allow-Origin", allowedOrigin)
+			if allowedOrigin != "*" {
+				w.Header().Add("Vary", "Origin")
+			}
+			if rule.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(rule.AllowedMethods, ","))
+
+			if r.Method == http.MethodOptions {
+				w.Header().Set("Access-Control-Allow-Headers", rule.allowHeaders(r.Header.Get("Access-Control-Request-Headers")))
+				if rule.MaxAge > 0 {
+					w.Header().Set("Access-Control-Max-Age", strconv.Itoa(rule.MaxAge))
+				}
+			} else {
+				w.Header().Set("Access-Control-Allow-Headers", strings.Join(rule.AllowedHeaders, ", "))
+			}
+		}
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
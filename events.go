@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// errWSHubClosed and errWSHubFull are the reasons wsHub.add can refuse to
+// register a new connection.
+var (
+	errWSHubClosed = errors.New("wsHub: server is shutting down")
+	errWSHubFull   = errors.New("wsHub: max clients reached")
+)
+
+// eventFrame is the JSON payload streamed to /events subscribers.
+type eventFrame struct {
+	Type       string `json:"type"`
+	ServerTime string `json:"server_time,omitempty"`
+}
+
+// wsClient tracks the two signals exchanged between a /events connection's
+// own serving goroutine (the only goroutine allowed to write to the
+// connection, per gorilla/websocket's concurrency rules) and the hub.
+type wsClient struct {
+	closeCh chan struct{} // closed by the hub to ask the owning goroutine to shut down
+	doneCh  chan struct{} // closed by the owning goroutine once it has stopped touching the conn
+}
+
+// wsHub tracks active /events connections so the server can ask every
+// client's own goroutine to send a final shutdown frame and close cleanly
+// during graceful shutdown, and so -ws-max-clients can be enforced.
+type wsHub struct {
+	mu       sync.Mutex
+	clients  map[*websocket.Conn]*wsClient
+	maxConns int
+	closed   bool
+}
+
+func newWSHub(maxConns int) *wsHub {
+	return &wsHub{
+		clients:  make(map[*websocket.Conn]*wsClient),
+		maxConns: maxConns,
+	}
+}
+
+// add registers conn and returns its wsClient. It refuses the registration
+// with errWSHubClosed once shutdown has begun, and with errWSHubFull once
+// -ws-max-clients is reached; both checks happen under the same lock that
+// shutdown uses to take its snapshot, so no connection can slip in after
+// shutdown has already decided which clients to notify.
+func (hub *wsHub) add(conn *websocket.Conn) (*wsClient, error) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	if hub.closed {
+		return nil, errWSHubClosed
+	}
+	if hub.maxConns > 0 && len(hub.clients) >= hub.maxConns {
+		return nil, errWSHubFull
+	}
+
+	client := &wsClient{closeCh: make(chan struct{}), doneCh: make(chan struct{})}
+	hub.clients[conn] = client
+	return client, nil
+}
+
+func (hub *wsHub) remove(conn *websocket.Conn) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	delete(hub.clients, conn)
+}
+
+// isShuttingDown reports whether shutdown has already begun, so eventsRoute
+// can refuse new upgrades before paying the cost of the handshake.
+func (hub *wsHub) isShuttingDown() bool {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	return hub.closed
+}
+
+// shutdown marks the hub closed so no further connections can register,
+// asks every already-registered connection's own goroutine to send a final
+// shutdown frame and close, then waits (bounded by ctx) for them to finish.
+// It never writes to a *websocket.Conn itself, since only the goroutine
+// that owns a connection may do so.
+func (hub *wsHub) shutdown(ctx context.Context) {
+	hub.mu.Lock()
+	hub.closed = true
+	clients := make([]*wsClient, 0, len(hub.clients))
+	for _, client := range hub.clients {
+		clients = append(clients, client)
+		close(client.closeCh)
+	}
+	hub.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		for _, client := range clients {
+			<-client.doneCh
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Println("Timed out closing /events clients during shutdown")
+	}
+}
+
+// checkWSOrigin validates the Upgrade request's Origin header against the
+// CORS rule that applies to /events, mirroring corsMiddleware's rules.
+func (server *Server) checkWSOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	rule := server.CORSConfig.ruleForPath(r.URL.Path)
+	if rule == nil {
+		return false
+	}
+	_, ok := rule.allowOrigin(origin)
+	return ok
+}
+
+// eventsRoute upgrades the connection to a WebSocket and streams a
+// heartbeat frame every heartbeat interval until the client disconnects or
+// the server shuts down.
+func (server *Server) eventsRoute(heartbeat time.Duration) http.HandlerFunc {
+	upgrader := websocket.Upgrader{
+		CheckOrigin: server.checkWSOrigin,
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if server.WSHub.isShuttingDown() {
+			http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Printf("WebSocket upgrade failed: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		client, err := server.WSHub.add(conn)
+		if err != nil {
+			if errors.Is(err, errWSHubClosed) {
+				conn.WriteJSON(eventFrame{Type: "shutdown"})
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, err.Error()))
+			} else {
+				conn.WriteJSON(eventFrame{Type: "error"})
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error()))
+			}
+			return
+		}
+		defer server.WSHub.remove(conn)
+		defer close(client.doneCh)
+
+		// Drain and discard any client-sent frames so control frames
+		// (ping/pong/close) are processed and a client disconnect is
+		// observed promptly.
+		readErrCh := make(chan error, 1)
+		go func() {
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					readErrCh <- err
+					return
+				}
+			}
+		}()
+
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				frame := eventFrame{Type: "heartbeat", ServerTime: time.Now().Format("2006-01-02 15:04:05.999999-07")}
+				if err := conn.WriteJSON(frame); err != nil {
+					return
+				}
+			case <-client.closeCh:
+				// Only this goroutine ever writes to conn, so the
+				// shutdown frame and close handshake happen here rather
+				// than from wsHub.shutdown.
+				conn.WriteJSON(eventFrame{Type: "shutdown"})
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				return
+			case <-readErrCh:
+				return
+			}
+		}
+	}
+}
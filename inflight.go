@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// maxInFlightMiddleware caps the number of simultaneous non-OPTIONS requests
+// in flight, modeled on the Kubernetes generic API server's
+// MaxInFlightLimit filter: requests acquire a slot from a buffered
+// semaphore channel and give it back once served, with a bounded wait for
+// a free slot while queued.
+//
+// Requests whose path matches longRunningPathRE bypass the limiter
+// entirely, since they are expected to hold a connection open (e.g. future
+// streaming endpoints) rather than complete quickly.
+func (server *Server) maxInFlightMiddleware(maxInFlight int, queueTimeout time.Duration, longRunningPathRE *regexp.Regexp, next http.Handler) http.Handler {
+	if maxInFlight <= 0 {
+		return next
+	}
+
+	sem := make(chan struct{}, maxInFlight)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if longRunningPathRE != nil && longRunningPathRE.MatchString(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		select {
+		case sem <- struct{}{}:
+			defer func() { <-sem }()
+			next.ServeHTTP(w, r)
+			return
+		default:
+		}
+
+		if server.Metrics != nil {
+			server.Metrics.incQueued()
+			defer server.Metrics.decQueued()
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), queueTimeout)
+		defer cancel()
+
+		select {
+		case sem <- struct{}{}:
+			defer func() { <-sem }()
+			next.ServeHTTP(w, r)
+		case <-ctx.Done():
+			w.Header().Set("Retry-After", strconv.Itoa(int(queueTimeout.Seconds())))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, `{"error":"server is at max in-flight request capacity"}`)
+		}
+	})
+}
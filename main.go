@@ -8,10 +8,9 @@ import (
 	"log"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
-	"strings"
+	"regexp"
 	"syscall"
 	"time"
 )
@@ -22,8 +21,10 @@ type Server struct {
 	Host string
 	Port int
 
-	CORSWhitelist         map[string]bool
-	AllowedDefaultMethods string
+	CORSConfig *CORSConfig
+
+	Metrics *Metrics
+	WSHub   *wsHub
 }
 
 type PingResponse struct {
@@ -38,41 +39,6 @@ type NowResponse struct {
 	ServerTime string `json:"server_time"`
 }
 
-// CORS middleware
-func (server *Server) corsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var allowedOrigin string
-		if server.CORSWhitelist["*"] {
-			allowedOrigin = "*"
-		} else {
-			origin := r.Header.Get("Origin")
-			if _, ok := server.CORSWhitelist[origin]; ok {
-				allowedOrigin = origin
-			}
-		}
-
-		if allowedOrigin != "" {
-			allowHeaders := "Content-Type"
-			if allowedOrigin != "*" {
-				allowHeaders += ", Authorization"
-				w.Header().Set("Access-Control-Allow-Credentials", "true")
-				// Don't allow credentials for wildcard
-			}
-			w.Header().Set("Access-Control-Allow-Origin", allowedOrigin)
-			w.Header().Set("Access-Control-Allow-Methods", server.AllowedDefaultMethods)
-			// Credentials are cookies, authorization headers, or TLS client certificates
-			w.Header().Set("Access-Control-Allow-Headers", allowHeaders)
-		}
-
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-
-		next.ServeHTTP(w, r)
-	})
-}
-
 // Log access requests in proper format
 func (server *Server) logMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -100,6 +66,9 @@ func (server *Server) panicMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if recoverErr := recover(); recoverErr != nil {
+				if server.Metrics != nil {
+					server.Metrics.recoveredPanic()
+				}
 				log.Println("recovered", recoverErr)
 				http.Error(w, "Internal server error", 500)
 			}
@@ -134,50 +103,82 @@ func main() {
 
 	var hostF, corsWhitelistF string
 	var portF, sReadTimeoutF, sWriteTimeoutF int
+	var metricsF bool
+	var metricsPortF int
+	var maxInFlightF int
+	var queueTimeoutF int
+	var longRunningPathREF string
+	var handlerTimeoutF int
+	var wsHeartbeatF int
+	var wsMaxClientsF int
+	var corsConfigF string
+	var corsAllowCredentialsF bool
+	var corsMaxAgeF int
 	flag.StringVar(&hostF, "host", "0.0.0.0", "Server host")
 	flag.IntVar(&portF, "port", 9001, "Server port")
 	flag.StringVar(&corsWhitelistF, "cors", "*", "List of comma separated domains for CORS")
+	flag.StringVar(&corsConfigF, "cors-config", "", "Path to a JSON file describing a CORSConfig with per-route rules; overrides -cors")
+	flag.BoolVar(&corsAllowCredentialsF, "cors-allow-credentials", true, "Allow credentials (cookies, Authorization headers) for non-wildcard origins from -cors")
+	flag.IntVar(&corsMaxAgeF, "cors-max-age", 600, "Preflight cache max-age in seconds for the -cors rule")
 	flag.IntVar(&sReadTimeoutF, "server-read-timeout", 10, "Server read timeout")
 	flag.IntVar(&sWriteTimeoutF, "server-write-timeout", 10, "Server write timeout")
+	flag.BoolVar(&metricsF, "metrics", false, "Expose a Prometheus-compatible /metrics endpoint")
+	flag.IntVar(&metricsPortF, "metrics-port", 0, "Serve /metrics on a separate port instead of the public server (0 means same port)")
+	flag.IntVar(&maxInFlightF, "max-in-flight", 0, "Maximum number of simultaneous non-OPTIONS requests (0 disables the limiter)")
+	flag.IntVar(&queueTimeoutF, "queue-timeout", 1, "Seconds a request may wait for a free in-flight slot before a 503 is returned")
+	flag.StringVar(&longRunningPathREF, "long-running-path-re", "^/events$", "Regex of paths that bypass the max-in-flight and handler-timeout limiters (e.g. /now, /events)")
+	flag.IntVar(&handlerTimeoutF, "handler-timeout", -1, "Seconds a handler may run before a 503 is returned (default: server-write-timeout minus 1)")
+	flag.IntVar(&wsHeartbeatF, "ws-heartbeat", 15, "Seconds between heartbeat frames sent to /events subscribers")
+	flag.IntVar(&wsMaxClientsF, "ws-max-clients", 100, "Maximum number of simultaneous /events subscribers (0 disables the limit)")
 
 	flag.Parse()
 
-	corsWhitelistRaw := strings.Split(strings.ReplaceAll(corsWhitelistF, " ", ""), ",")
+	if handlerTimeoutF < 0 {
+		handlerTimeoutF = sWriteTimeoutF - 1
+	}
 
-	corsWhitelist := make(map[string]bool)
-	for _, uri := range corsWhitelistRaw {
-		if uri == "*" {
-			corsWhitelist["*"] = true
-			break
-		}
-		valid, err := url.ParseRequestURI(uri)
+	var longRunningPathRE *regexp.Regexp
+	if longRunningPathREF != "" {
+		var err error
+		longRunningPathRE, err = regexp.Compile(longRunningPathREF)
 		if err != nil {
-			log.Printf("Ignoring incorrect URI %s", uri)
-			continue
+			log.Fatalf("Invalid -long-running-path-re: %v", err)
 		}
-		corsWhitelist[valid.String()] = true
 	}
 
-	corsSlice := make([]string, 0, len(corsWhitelist))
-	for k := range corsWhitelist {
-		corsSlice = append(corsSlice, k)
+	var corsConfig *CORSConfig
+	if corsConfigF != "" {
+		var err error
+		corsConfig, err = loadCORSConfig(corsConfigF)
+		if err != nil {
+			log.Fatalf("Unable to load -cors-config %s: %v", corsConfigF, err)
+		}
+	} else {
+		corsConfig = newCORSConfigFromWhitelist(corsWhitelistF, corsAllowCredentialsF, corsMaxAgeF)
 	}
 
 	server := Server{
 		Host: hostF,
 		Port: portF,
 
-		CORSWhitelist:         corsWhitelist,
-		AllowedDefaultMethods: "GET,OPTIONS",
+		CORSConfig: corsConfig,
 	}
 
+	if metricsF {
+		server.Metrics = NewMetrics()
+	}
+	server.WSHub = newWSHub(wsMaxClientsF)
+
 	serveMux := http.NewServeMux()
-	serveMux.HandleFunc("/now", server.nowRoute)
-	serveMux.HandleFunc("/ping", server.pingRoute)
-	serveMux.HandleFunc("/version", server.versionRoute)
+	serveMux.HandleFunc("/now", server.metricsMiddleware("/now", server.nowRoute))
+	serveMux.HandleFunc("/ping", server.metricsMiddleware("/ping", server.pingRoute))
+	serveMux.HandleFunc("/version", server.metricsMiddleware("/version", server.versionRoute))
+	serveMux.HandleFunc("/events", server.eventsRoute(time.Duration(wsHeartbeatF)*time.Second))
 
 	// Set list of common middleware, from bottom to top
 	commonHandler := server.corsMiddleware(serveMux)
+	commonHandler = server.maxInFlightMiddleware(maxInFlightF, time.Duration(queueTimeoutF)*time.Second, longRunningPathRE, commonHandler)
+	commonHandler = server.handlerTimeoutMiddleware(time.Duration(handlerTimeoutF)*time.Second, longRunningPathRE, commonHandler)
 	commonHandler = server.logMiddleware(commonHandler)
 	commonHandler = server.panicMiddleware(commonHandler)
 
@@ -188,26 +189,59 @@ func main() {
 		WriteTimeout: time.Duration(sWriteTimeoutF) * time.Second,
 	}
 
+	var metricsServer *http.Server
+	if server.Metrics != nil {
+		if metricsPortF == 0 {
+			// No separate port requested: fall back to serving /metrics
+			// alongside the public routes.
+			serveMux.HandleFunc("/metrics", server.metricsRoute)
+		} else {
+			metricsMux := http.NewServeMux()
+			metricsMux.HandleFunc("/metrics", server.metricsRoute)
+			metricsServer = &http.Server{
+				Addr:    fmt.Sprintf("%s:%d", server.Host, metricsPortF),
+				Handler: metricsMux,
+			}
+		}
+	}
+
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
 	go func() {
-		log.Printf("Starting ping HTTP server at %s:%d and whitelisted CORS %v", server.Host, server.Port, corsSlice)
+		log.Printf("Starting ping HTTP server at %s:%d with %d CORS rule(s)", server.Host, server.Port, len(server.CORSConfig.Rules))
 		if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Server error: %v", err)
 		}
 	}()
 
+	if metricsServer != nil {
+		go func() {
+			log.Printf("Starting metrics HTTP server at %s", metricsServer.Addr)
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Metrics server error: %v", err)
+			}
+		}()
+	}
+
 	<-ctx.Done()
 	log.Printf("Shutting down server gracefully in %d seconds...", shutdownTimeout)
 
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(shutdownTimeout)*time.Second)
 	defer cancel()
 
+	server.WSHub.shutdown(shutdownCtx)
+
 	if err := s.Shutdown(shutdownCtx); err != nil {
 		log.Printf("Graceful shutdown failed: %v", err)
 		os.Exit(1)
 	}
 
+	if metricsServer != nil {
+		if err := metricsServer.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Metrics server graceful shutdown failed: %v", err)
+		}
+	}
+
 	log.Println("Server stopped")
 }
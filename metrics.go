@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// durationBuckets are the upper bounds (in seconds) used for the request
+// duration histogram, following Prometheus' default client bucket layout.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// routeStatusKey identifies a route+method+status combination for counters.
+type routeStatusKey struct {
+	route  string
+	method string
+	status int
+}
+
+// histogramKey identifies a route+method combination for the duration histogram.
+type histogramKey struct {
+	route  string
+	method string
+}
+
+type histogram struct {
+	buckets []uint64 // counts per bucket, same length as durationBuckets
+	sum     float64
+	count   uint64
+}
+
+// Metrics holds the in-process counters and histograms exposed at /metrics.
+// All fields are guarded by mu except inFlight and queued, which are
+// updated with atomic operations from the hot request path.
+type Metrics struct {
+	mu        sync.Mutex
+	requests  map[routeStatusKey]uint64
+	durations map[histogramKey]*histogram
+	panics    uint64
+	inFlight  int64
+	queued    int64
+}
+
+// NewMetrics returns an empty, ready-to-use Metrics instance.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:  make(map[routeStatusKey]uint64),
+		durations: make(map[histogramKey]*histogram),
+	}
+}
+
+func (m *Metrics) observeRequest(route, method string, status int, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[routeStatusKey{route: route, method: method, status: status}]++
+
+	hk := histogramKey{route: route, method: method}
+	h, ok := m.durations[hk]
+	if !ok {
+		h = &histogram{buckets: make([]uint64, len(durationBuckets))}
+		m.durations[hk] = h
+	}
+	seconds := elapsed.Seconds()
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+			break
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+func (m *Metrics) recoveredPanic() {
+	atomic.AddUint64(&m.panics, 1)
+}
+
+func (m *Metrics) incInFlight() { atomic.AddInt64(&m.inFlight, 1) }
+func (m *Metrics) decInFlight() { atomic.AddInt64(&m.inFlight, -1) }
+func (m *Metrics) incQueued()   { atomic.AddInt64(&m.queued, 1) }
+func (m *Metrics) decQueued()   { atomic.AddInt64(&m.queued, -1) }
+
+// responseWriter wraps http.ResponseWriter to capture the status code
+// written by a handler so middleware can observe it after the fact.
+type responseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (rw *responseWriter) WriteHeader(status int) {
+	if rw.wroteHeader {
+		return
+	}
+	rw.status = status
+	rw.wroteHeader = true
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	return rw.ResponseWriter.Write(b)
+}
+
+// metricsMiddleware records RED metrics (rate, errors, duration) for every
+// request that passes through it, keyed by route and method.
+func (server *Server) metricsMiddleware(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if server.Metrics == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		server.Metrics.incInFlight()
+		defer server.Metrics.decInFlight()
+
+		rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(rw, r)
+		server.Metrics.observeRequest(route, r.Method, rw.status, time.Since(start))
+	}
+}
+
+// metricsRoute renders the collected metrics in Prometheus text exposition
+// format.
+func (server *Server) metricsRoute(w http.ResponseWriter, r *http.Request) {
+	m := server.Metrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+
+	fmt.Fprintln(&b, "# HELP sping_requests_total Total number of HTTP requests handled.")
+	fmt.Fprintln(&b, "# TYPE sping_requests_total counter")
+	keys := make([]routeStatusKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].status < keys[j].status
+	})
+	for _, k := range keys {
+		fmt.Fprintf(&b, "sping_requests_total{route=%q,method=%q,status=\"%d\"} %d\n",
+			k.route, k.method, k.status, m.requests[k])
+	}
+
+	fmt.Fprintln(&b, "# HELP sping_request_duration_seconds Request duration in seconds.")
+	fmt.Fprintln(&b, "# TYPE sping_request_duration_seconds histogram")
+	hkeys := make([]histogramKey, 0, len(m.durations))
+	for k := range m.durations {
+		hkeys = append(hkeys, k)
+	}
+	sort.Slice(hkeys, func(i, j int) bool {
+		if hkeys[i].route != hkeys[j].route {
+			return hkeys[i].route < hkeys[j].route
+		}
+		return hkeys[i].method < hkeys[j].method
+	})
+	for _, k := range hkeys {
+		h := m.durations[k]
+		var cumulative uint64
+		for i, bound := range durationBuckets {
+			cumulative += h.buckets[i]
+			fmt.Fprintf(&b, "sping_request_duration_seconds_bucket{route=%q,method=%q,le=\"%g\"} %d\n",
+				k.route, k.method, bound, cumulative)
+		}
+		fmt.Fprintf(&b, "sping_request_duration_seconds_bucket{route=%q,method=%q,le=\"+Inf\"} %d\n",
+			k.route, k.method, h.count)
+		fmt.Fprintf(&b, "sping_request_duration_seconds_sum{route=%q,method=%q} %g\n", k.route, k.method, h.sum)
+		fmt.Fprintf(&b, "sping_request_duration_seconds_count{route=%q,method=%q} %d\n", k.route, k.method, h.count)
+	}
+
+	fmt.Fprintln(&b, "# HELP sping_requests_in_flight Number of requests currently being served.")
+	fmt.Fprintln(&b, "# TYPE sping_requests_in_flight gauge")
+	fmt.Fprintf(&b, "sping_requests_in_flight %d\n", atomic.LoadInt64(&m.inFlight))
+
+	fmt.Fprintln(&b, "# HELP sping_requests_queued Number of requests waiting to enter the in-flight limiter.")
+	fmt.Fprintln(&b, "# TYPE sping_requests_queued gauge")
+	fmt.Fprintf(&b, "sping_requests_queued %d\n", atomic.LoadInt64(&m.queued))
+
+	fmt.Fprintln(&b, "# HELP sping_panics_recovered_total Total number of panics recovered by panicMiddleware.")
+	fmt.Fprintln(&b, "# TYPE sping_panics_recovered_total counter")
+	fmt.Fprintf(&b, "sping_panics_recovered_total %d\n", atomic.LoadUint64(&m.panics))
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// bufferingResponseWriter buffers a handler's header and body in memory so
+// handlerTimeoutMiddleware can decide, once the handler returns or the
+// deadline fires, exactly what gets written to the real
+// http.ResponseWriter. It deliberately does not implement http.Flusher:
+// once the timeout branch has been taken, the real ResponseWriter belongs
+// to the timeout response and must never see a chunked write from the
+// slow handler.
+type bufferingResponseWriter struct {
+	mu          sync.Mutex
+	header      http.Header
+	body        bytes.Buffer
+	status      int
+	wroteHeader bool
+	timedOut    bool
+}
+
+func newBufferingResponseWriter() *bufferingResponseWriter {
+	return &bufferingResponseWriter{header: make(http.Header), status: http.StatusOK}
+}
+
+func (bw *bufferingResponseWriter) Header() http.Header {
+	return bw.header
+}
+
+func (bw *bufferingResponseWriter) WriteHeader(status int) {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	if bw.timedOut || bw.wroteHeader {
+		return
+	}
+	bw.status = status
+	bw.wroteHeader = true
+}
+
+func (bw *bufferingResponseWriter) Write(b []byte) (int, error) {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	if bw.timedOut {
+		// The deadline already fired and a response was sent; silently
+		// discard anything the abandoned handler still tries to write.
+		return len(b), nil
+	}
+	bw.wroteHeader = true
+	return bw.body.Write(b)
+}
+
+// markTimedOut flags the buffer as abandoned so any subsequent writes from
+// the still-running handler goroutine are dropped instead of racing with
+// the timeout response already sent on the real ResponseWriter.
+func (bw *bufferingResponseWriter) markTimedOut() {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	bw.timedOut = true
+}
+
+// recoverPanic overwrites whatever the handler had buffered so far with a
+// 500 response, unless the deadline already fired and ownership of the
+// real ResponseWriter has moved on.
+func (bw *bufferingResponseWriter) recoverPanic() {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	if bw.timedOut {
+		return
+	}
+	bw.header = http.Header{"Content-Type": []string{"application/json"}}
+	bw.body.Reset()
+	bw.body.WriteString(`{"error":"Internal server error"}`)
+	bw.status = http.StatusInternalServerError
+	bw.wroteHeader = true
+}
+
+type timeoutErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// handlerTimeoutMiddleware wraps commonHandler with a per-request deadline.
+// The handler runs against a bufferingResponseWriter; if it finishes before
+// the deadline, its buffered status/headers/body are copied verbatim to the
+// real ResponseWriter with an explicit Content-Length so the client always
+// sees a complete, non-chunked response. If the deadline fires first, the
+// middleware writes a well-formed JSON error with its own Content-Length
+// and abandons the handler goroutine, which can no longer affect the real
+// ResponseWriter.
+//
+// Requests whose path matches longRunningPathRE bypass the deadline
+// entirely: a bufferingResponseWriter cannot be hijacked, so connections
+// that upgrade (e.g. the /events WebSocket route) must reach next
+// directly instead.
+func (server *Server) handlerTimeoutMiddleware(timeout time.Duration, longRunningPathRE *regexp.Regexp, next http.Handler) http.Handler {
+	if timeout <= 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if longRunningPathRE != nil && longRunningPathRE.MatchString(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		bw := newBufferingResponseWriter()
+		done := make(chan struct{})
+
+		go func() {
+			defer close(done)
+			defer func() {
+				if recoverErr := recover(); recoverErr != nil {
+					if server.Metrics != nil {
+						server.Metrics.recoveredPanic()
+					}
+					log.Println("recovered", recoverErr)
+					bw.recoverPanic()
+				}
+			}()
+			next.ServeHTTP(bw, r)
+		}()
+
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		select {
+		case <-done:
+			bw.mu.Lock()
+			defer bw.mu.Unlock()
+			for k, values := range bw.header {
+				for _, v := range values {
+					w.Header().Add(k, v)
+				}
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(bw.body.Len()))
+			w.Header().Del("Transfer-Encoding")
+			w.WriteHeader(bw.status)
+			w.Write(bw.body.Bytes())
+		case <-timer.C:
+			bw.markTimedOut()
+			body, _ := json.Marshal(timeoutErrorResponse{Error: "handler did not respond before the timeout"})
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			w.Header().Del("Transfer-Encoding")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write(body)
+		}
+	})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHandlerTimeoutMiddlewareSlowHandler(t *testing.T) {
+	server := &Server{}
+
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("too late"))
+	})
+
+	handler := server.handlerTimeoutMiddleware(10*time.Millisecond, nil, slow)
+
+	req := httptest.NewRequest(http.MethodGet, "/slow", nil)
+	rec := httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, req)
+
+	resp := rec.Result()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d, got %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response body: %v", err)
+	}
+
+	if cl := resp.Header.Get("Content-Length"); cl == "" {
+		t.Fatalf("expected an explicit Content-Length header")
+	}
+	if got, want := len(body), rec.Body.Len(); got != want {
+		t.Fatalf("response body truncated: read %d bytes, recorder holds %d", got, want)
+	}
+
+	// Give the abandoned slow handler time to finish and attempt its
+	// write; it must not be able to affect the already-sent response.
+	time.Sleep(150 * time.Millisecond)
+	if rec.Body.String() != string(body) {
+		t.Fatalf("late write from abandoned handler leaked into the response")
+	}
+}
+
+func TestHandlerTimeoutMiddlewareRecoversPanic(t *testing.T) {
+	server := &Server{}
+
+	panicky := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+
+	handler := server.handlerTimeoutMiddleware(50*time.Millisecond, nil, panicky)
+
+	req := httptest.NewRequest(http.MethodGet, "/panic", nil)
+	rec := httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, req)
+
+	resp := rec.Result()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected status %d, got %d", http.StatusInternalServerError, resp.StatusCode)
+	}
+}
+
+func TestHandlerTimeoutMiddlewareFastHandler(t *testing.T) {
+	server := &Server{}
+
+	fast := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	handler := server.handlerTimeoutMiddleware(50*time.Millisecond, nil, fast)
+
+	req := httptest.NewRequest(http.MethodGet, "/fast", nil)
+	rec := httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, req)
+
+	resp := rec.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if rec.Body.String() != "ok" {
+		t.Fatalf("expected body %q, got %q", "ok", rec.Body.String())
+	}
+}